@@ -0,0 +1,137 @@
+package gubernator
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// hitEnvelope wraps a RateLimitReq queued via QueueHit with the monotonic
+// timestamp it was enqueued at, so runAsyncHits and sendHits can measure how
+// long it waited before being batched and delivered.
+type hitEnvelope struct {
+	req        *RateLimitReq
+	enqueuedAt time.Time
+}
+
+// delayWindowSize bounds how many recent latency samples are kept per peer
+// for percentile estimation.
+const delayWindowSize = 256
+
+// delayHistogram is a fixed-window latency histogram used to derive
+// P50/P95/P99 for a single peer.
+type delayHistogram struct {
+	mu      sync.Mutex
+	samples [delayWindowSize]time.Duration
+	head    int
+	len     int
+}
+
+func (h *delayHistogram) record(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples[h.head] = d
+	h.head = (h.head + 1) % delayWindowSize
+	if h.len < delayWindowSize {
+		h.len++
+	}
+}
+
+// DelayPercentiles summarizes P50/P95/P99 delay for a peer.
+type DelayPercentiles struct {
+	P50 time.Duration `json:"p50"`
+	P95 time.Duration `json:"p95"`
+	P99 time.Duration `json:"p99"`
+}
+
+func (h *delayHistogram) percentiles() DelayPercentiles {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.len == 0 {
+		return DelayPercentiles{}
+	}
+	buf := make([]time.Duration, h.len)
+	copy(buf, h.samples[:h.len])
+	sort.Slice(buf, func(i, j int) bool { return buf[i] < buf[j] })
+
+	pick := func(p float64) time.Duration {
+		idx := int(p * float64(len(buf)))
+		if idx >= len(buf) {
+			idx = len(buf) - 1
+		}
+		return buf[idx]
+	}
+	return DelayPercentiles{
+		P50: pick(0.50),
+		P95: pick(0.95),
+		P99: pick(0.99),
+	}
+}
+
+// PeerDelayStats reports queue and delivery delay percentiles for a single
+// peer's async hit pipeline. Queue delay is the time a hit waited between
+// QueueHit and sendHits building the peer request; delivery delay extends
+// that until the RPC completes.
+type PeerDelayStats struct {
+	Host          string           `json:"host"`
+	QueueDelay    DelayPercentiles `json:"queue_delay"`
+	DeliveryDelay DelayPercentiles `json:"delivery_delay"`
+}
+
+// delayTracker aggregates per-peer queue and delivery delay histograms for
+// the async hit pipeline.
+type delayTracker struct {
+	mu       sync.Mutex
+	queue    map[string]*delayHistogram
+	delivery map[string]*delayHistogram
+}
+
+func newDelayTracker() *delayTracker {
+	return &delayTracker{
+		queue:    make(map[string]*delayHistogram),
+		delivery: make(map[string]*delayHistogram),
+	}
+}
+
+func (t *delayTracker) histogramFor(m map[string]*delayHistogram, host string) *delayHistogram {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := m[host]
+	if !ok {
+		h = &delayHistogram{}
+		m[host] = h
+	}
+	return h
+}
+
+func (t *delayTracker) recordQueueDelay(host string, d time.Duration) {
+	t.histogramFor(t.queue, host).record(d)
+	observeQueueDelay(host, d)
+}
+
+func (t *delayTracker) recordDeliveryDelay(host string, d time.Duration) {
+	t.histogramFor(t.delivery, host).record(d)
+	observeDeliveryDelay(host, d)
+}
+
+func (t *delayTracker) stats() []PeerDelayStats {
+	t.mu.Lock()
+	hosts := make(map[string]struct{}, len(t.queue))
+	for host := range t.queue {
+		hosts[host] = struct{}{}
+	}
+	for host := range t.delivery {
+		hosts[host] = struct{}{}
+	}
+	t.mu.Unlock()
+
+	out := make([]PeerDelayStats, 0, len(hosts))
+	for host := range hosts {
+		out = append(out, PeerDelayStats{
+			Host:          host,
+			QueueDelay:    t.histogramFor(t.queue, host).percentiles(),
+			DeliveryDelay: t.histogramFor(t.delivery, host).percentiles(),
+		})
+	}
+	return out
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/mailgun/holster"
 	"github.com/sirupsen/logrus"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -12,33 +13,61 @@ import (
 // the cluster periodically when a global rate limit we own updates.
 type globalManager struct {
 	stats          ServerStats
-	asyncQueue     chan *RateLimitReq
+	asyncQueue     chan *hitEnvelope
 	broadcastQueue chan *RateLimitReq
 	wg             holster.WaitGroup
 	conf           BehaviorConfig
 	log            *logrus.Entry
 	instance       *Instance
+
+	// health tracks per-peer latency/error EWMAs and circuit-breaker state
+	// so a slow or flaky peer doesn't stall every broadcast cycle.
+	healthMu sync.Mutex
+	health   map[string]*peerHealth
+
+	// droppedHits, sampledHits, and droppedUpdates count requests affected by
+	// OverflowPolicy when the async/broadcast queues are full. Hit and
+	// update drops are counted separately so the operator signal isn't
+	// muddied by conflating the two.
+	droppedHits    int64
+	sampledHits    int64
+	droppedUpdates int64
+
+	// delays tracks per-peer queue/delivery delay histograms for the async
+	// hit pipeline.
+	delays *delayTracker
+
+	// retryQueues holds broadcasts that failed to reach a peer, pending
+	// retry with backoff, keyed by peer host.
+	retryMu          sync.Mutex
+	retryQueues      map[string]*peerRetryQueue
+	retriesSucceeded int64
+	retriesAbandoned int64
 }
 
 func newGlobalManager(conf BehaviorConfig, instance *Instance) *globalManager {
 	gm := globalManager{
-		log:            log.WithField("category", "global-manager"),
-		asyncQueue:     make(chan *RateLimitReq, 0),
-		broadcastQueue: make(chan *RateLimitReq, 0),
-		instance:       instance,
-		conf:           conf,
+		log:         log.WithField("category", "global-manager"),
+		instance:    instance,
+		conf:        conf,
+		health:      make(map[string]*peerHealth),
+		delays:      newDelayTracker(),
+		retryQueues: make(map[string]*peerRetryQueue),
 	}
+	gm.asyncQueue = make(chan *hitEnvelope, gm.queueLimit())
+	gm.broadcastQueue = make(chan *RateLimitReq, gm.queueLimit())
 	gm.runAsyncHits()
 	gm.runBroadcasts()
+	gm.runRetries()
 	return &gm
 }
 
 func (gm *globalManager) QueueHit(r *RateLimitReq) {
-	gm.asyncQueue <- r
+	gm.enqueueHit(&hitEnvelope{req: r, enqueuedAt: time.Now()})
 }
 
 func (gm *globalManager) QueueUpdate(r *RateLimitReq) {
-	gm.broadcastQueue <- r
+	gm.enqueueUpdate(r)
 }
 
 func (gm *globalManager) Stats(clear bool) ServerStats {
@@ -46,11 +75,23 @@ func (gm *globalManager) Stats(clear bool) ServerStats {
 		defer func() {
 			atomic.StoreInt64(&gm.stats.AsyncGlobalsCount, 0)
 			atomic.StoreInt64(&gm.stats.BroadcastDuration, 0)
+			atomic.StoreInt64(&gm.droppedHits, 0)
+			atomic.StoreInt64(&gm.sampledHits, 0)
+			atomic.StoreInt64(&gm.droppedUpdates, 0)
 		}()
 	}
 	return ServerStats{
-		AsyncGlobalsCount: atomic.LoadInt64(&gm.stats.AsyncGlobalsCount),
-		BroadcastDuration: atomic.LoadInt64(&gm.stats.BroadcastDuration),
+		AsyncGlobalsCount:   atomic.LoadInt64(&gm.stats.AsyncGlobalsCount),
+		BroadcastDuration:   atomic.LoadInt64(&gm.stats.BroadcastDuration),
+		AsyncQueueDepth:     int64(len(gm.asyncQueue)),
+		BroadcastQueueDepth: int64(len(gm.broadcastQueue)),
+		DroppedHits:         atomic.LoadInt64(&gm.droppedHits),
+		SampledHits:         atomic.LoadInt64(&gm.sampledHits),
+		DroppedUpdates:      atomic.LoadInt64(&gm.droppedUpdates),
+		PeerDelayStats:      gm.delays.stats(),
+		RetryQueueDepth:     gm.retryQueueDepth(),
+		RetriesSucceeded:    atomic.LoadInt64(&gm.retriesSucceeded),
+		RetriesAbandoned:    atomic.LoadInt64(&gm.retriesAbandoned),
 	}
 }
 
@@ -58,24 +99,30 @@ func (gm *globalManager) Stats(clear bool) ServerStats {
 // be sent to their owning peers.
 func (gm *globalManager) runAsyncHits() {
 	var interval = NewInterval(gm.conf.GlobalSyncWait)
-	hits := make(map[string]*RateLimitReq)
+	hits := make(map[string]*hitEnvelope)
 
 	gm.wg.Until(func(done chan struct{}) bool {
 		select {
-		case r := <-gm.asyncQueue:
-			// Aggregate the hits into a single request
-			key := r.HashKey()
-			_, ok := hits[key]
+		case e := <-gm.asyncQueue:
+			// Aggregate the hits into a single request. The envelope already
+			// in the map is kept, with the earlier of the two enqueuedAt
+			// times (a re-queued hit can be older than one already batched),
+			// so it reflects the oldest hit waiting in this batch.
+			key := e.req.HashKey()
+			existing, ok := hits[key]
 			if ok {
-				hits[key].Hits += r.Hits
+				existing.req.Hits += e.req.Hits
+				if e.enqueuedAt.Before(existing.enqueuedAt) {
+					existing.enqueuedAt = e.enqueuedAt
+				}
 			} else {
-				hits[key] = r
+				hits[key] = e
 			}
 
 			// Send the hits if we reached our batch limit
 			if len(hits) == gm.conf.GlobalBatchLimit {
 				gm.sendHits(hits)
-				hits = make(map[string]*RateLimitReq)
+				hits = make(map[string]*hitEnvelope)
 				return true
 			}
 
@@ -88,7 +135,7 @@ func (gm *globalManager) runAsyncHits() {
 		case <-interval.C:
 			if len(hits) != 0 {
 				gm.sendHits(hits)
-				hits = make(map[string]*RateLimitReq)
+				hits = make(map[string]*hitEnvelope)
 			}
 		case <-done:
 			return false
@@ -99,41 +146,79 @@ func (gm *globalManager) runAsyncHits() {
 
 // sendHits takes the hits collected by runAsyncHits and sends them to their
 // owning peers
-func (gm *globalManager) sendHits(hits map[string]*RateLimitReq) {
+func (gm *globalManager) sendHits(hits map[string]*hitEnvelope) {
 	type pair struct {
-		client *PeerClient
-		req    GetPeerRateLimitsReq
+		client    *PeerClient
+		req       GetPeerRateLimitsReq
+		envelopes []*hitEnvelope
 	}
 	peerRequests := make(map[string]*pair)
+	sendStart := time.Now()
 
 	// Assign each request to a peer
-	for _, r := range hits {
-		peer, err := gm.instance.GetPeer(r.HashKey())
+	for _, e := range hits {
+		peer, err := gm.instance.GetPeer(e.req.HashKey())
 		if err != nil {
-			gm.log.WithError(err).Errorf("while getting peer for hash key '%s'", r.HashKey())
+			gm.log.WithError(err).Errorf("while getting peer for hash key '%s'", e.req.HashKey())
 			continue
 		}
 
+		gm.delays.recordQueueDelay(peer.host, sendStart.Sub(e.enqueuedAt))
+
 		p, ok := peerRequests[peer.host]
 		if ok {
-			p.req.Requests = append(p.req.Requests, r)
+			p.req.Requests = append(p.req.Requests, e.req)
+			p.envelopes = append(p.envelopes, e)
 		} else {
 			peerRequests[peer.host] = &pair{
-				client: peer,
-				req:    GetPeerRateLimitsReq{Requests: []*RateLimitReq{r}},
+				client:    peer,
+				req:       GetPeerRateLimitsReq{Requests: []*RateLimitReq{e.req}},
+				envelopes: []*hitEnvelope{e},
 			}
 		}
 	}
 
 	// Send the rate limit requests to their respective owning peers.
 	for _, p := range peerRequests {
-		ctx, cancel := context.WithTimeout(context.Background(), gm.conf.GlobalTimeout)
+		ph := gm.peerHealthFor(p.client.host)
+		if !ph.allow() {
+			// The hits in this batch were never transmitted, so re-queuing
+			// them is safe (unlike retrying after an actual RPC attempt,
+			// there's no risk of the owner having already applied them).
+			// Otherwise they'd be lost for the entire cooldown window, which
+			// can grow to a minute with repeated backoff.
+			//
+			// sendHits runs on the asyncQueue's sole consumer goroutine, so
+			// this must not block: requeueHit drops and counts on a full
+			// queue instead of risking a deadlock against ourselves.
+			gm.log.Warnf("peer '%s' unhealthy, re-queuing global hit batch for next cycle", p.client.host)
+			for _, e := range p.envelopes {
+				gm.requeueHit(e)
+			}
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), ph.timeout(gm.conf.GlobalTimeout))
+		start := time.Now()
 		_, err := p.client.GetPeerRateLimits(ctx, &p.req)
 		cancel()
+		ph.report(time.Since(start), err, gm.peerHealthThreshold())
+
+		completed := time.Now()
+		for _, e := range p.envelopes {
+			gm.delays.recordDeliveryDelay(p.client.host, completed.Sub(e.enqueuedAt))
+		}
 
 		if err != nil {
+			// Unlike a skipped-before-sending batch above, this RPC was
+			// actually attempted: the error may mean the owner never saw it,
+			// or that it applied the delta and only the ack was lost. Hit
+			// deltas aren't idempotent, so re-sending risks double-counting
+			// and we deliberately don't put them on the retry queue (see
+			// retry_queue.go). We log and move on, accepting the small risk
+			// of undercounting rather than the risk of overcounting.
 			gm.log.WithError(err).
-				Errorf("error sending global hits to '%s'", p.client.host)
+				Errorf("error sending global hits to '%s', hits may be undercounted", p.client.host)
 			continue
 		}
 	}
@@ -204,18 +289,38 @@ func (gm *globalManager) updatePeers(updates map[string]*RateLimitReq) {
 			continue
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), gm.conf.GlobalTimeout)
+		ph := gm.peerHealthFor(peer.host)
+		if !ph.allow() {
+			gm.log.Warnf("skipping global update broadcast to unhealthy peer '%s'", peer.host)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), ph.timeout(gm.conf.GlobalTimeout))
+		rpcStart := time.Now()
 		_, err := peer.UpdatePeerGlobals(ctx, &req)
 		cancel()
+		ph.report(time.Since(rpcStart), err, gm.peerHealthThreshold())
 
+		q := gm.retryQueueFor(peer.host)
 		if err != nil {
 			gm.log.WithError(err).Errorf("error sending global updates to '%s'", peer.host)
+			for _, g := range req.Globals {
+				q.put(&retryItem{Key: g.Key, Update: g, NextAttempt: time.Now()})
+			}
 			continue
 		}
+
+		// This broadcast just delivered the latest status directly, so drop
+		// any older, not-yet-retried status for the same keys still sitting
+		// in the retry queue — otherwise the drainer could later re-send a
+		// stale snapshot and regress the peer past what we just sent it.
+		for _, g := range req.Globals {
+			q.remove(g.Key)
+		}
 	}
 
 	duration := int64(time.Now().Sub(start))
 	if atomic.LoadInt64(&gm.stats.BroadcastDuration) < duration {
 		atomic.StoreInt64(&gm.stats.BroadcastDuration, duration)
 	}
-}
\ No newline at end of file
+}
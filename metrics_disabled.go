@@ -0,0 +1,11 @@
+//go:build !metrics
+// +build !metrics
+
+package gubernator
+
+import "time"
+
+// observeQueueDelay and observeDeliveryDelay are no-ops unless built with the
+// "metrics" build tag, which enables Prometheus instrumentation.
+func observeQueueDelay(peer string, d time.Duration)    {}
+func observeDeliveryDelay(peer string, d time.Duration) {}
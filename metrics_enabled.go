@@ -0,0 +1,40 @@
+//go:build metrics
+// +build metrics
+
+package gubernator
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queueDelaySeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gubernator",
+		Subsystem: "global_manager",
+		Name:      "queue_delay_seconds",
+		Help:      "Time a hit spent queued before being batched into a peer broadcast.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"peer"})
+
+	deliveryDelaySeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gubernator",
+		Subsystem: "global_manager",
+		Name:      "delivery_delay_seconds",
+		Help:      "Time from a hit being queued to its broadcast RPC completing.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"peer"})
+)
+
+func init() {
+	prometheus.MustRegister(queueDelaySeconds, deliveryDelaySeconds)
+}
+
+func observeQueueDelay(peer string, d time.Duration) {
+	queueDelaySeconds.WithLabelValues(peer).Observe(d.Seconds())
+}
+
+func observeDeliveryDelay(peer string, d time.Duration) {
+	deliveryDelaySeconds.WithLabelValues(peer).Observe(d.Seconds())
+}
@@ -0,0 +1,279 @@
+package gubernator
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// peerState is the circuit-breaker state globalManager tracks for a single
+// peer, modeled after the closed/open/half-open states used by standard
+// circuit breakers and by go-ethereum's LES serverpool node scoring.
+type peerState int
+
+const (
+	peerStateClosed peerState = iota
+	peerStateOpen
+	peerStateHalfOpen
+)
+
+func (s peerState) String() string {
+	switch s {
+	case peerStateOpen:
+		return "open"
+	case peerStateHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+const (
+	// ewmaAlpha weights how quickly the latency and error-rate estimates
+	// react to a new sample.
+	ewmaAlpha = 0.2
+
+	defaultPeerHealthThreshold = 0.5
+	defaultPeerBaseCooldown    = time.Second
+	defaultPeerMaxCooldown     = time.Minute
+	latencyWindowSize          = 32
+)
+
+// peerHealth tracks latency and error-rate statistics for a single peer and
+// implements a circuit breaker: a peer whose score drops below threshold is
+// tripped "open" for a cooldown window that backs off exponentially on
+// repeated failures, then allowed exactly one "half-open" probe request
+// before closing again.
+type peerHealth struct {
+	mu sync.Mutex
+
+	ewmaLatency time.Duration
+	ewmaErrors  float64
+	latencies   [latencyWindowSize]time.Duration
+	latencyHead int
+	latencyLen  int
+
+	state         peerState
+	cooldown      time.Duration
+	openedAt      time.Time
+	probeInFlight bool
+}
+
+func newPeerHealth() *peerHealth {
+	return &peerHealth{cooldown: defaultPeerBaseCooldown}
+}
+
+// allow reports whether a request to this peer should be attempted right
+// now. A closed peer always allows; an open peer allows nothing until its
+// cooldown expires, at which point it moves to half-open and allows exactly
+// one probe through.
+func (p *peerHealth) allow() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch p.state {
+	case peerStateOpen:
+		if time.Since(p.openedAt) < p.cooldown {
+			return false
+		}
+		p.state = peerStateHalfOpen
+		p.probeInFlight = true
+		return true
+	case peerStateHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// report records the outcome of a request to this peer and updates the
+// circuit-breaker state. threshold is the score below which a closed peer
+// trips open.
+func (p *peerHealth) report(latency time.Duration, err error, threshold float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.probeInFlight = false
+	p.recordLatencyLocked(latency)
+
+	sample := 0.0
+	if err != nil {
+		sample = 1.0
+	}
+	if p.ewmaLatency == 0 && p.ewmaErrors == 0 {
+		p.ewmaErrors = sample
+	} else {
+		p.ewmaErrors = ewmaAlpha*sample + (1-ewmaAlpha)*p.ewmaErrors
+	}
+	if p.ewmaLatency == 0 {
+		p.ewmaLatency = latency
+	} else {
+		p.ewmaLatency = time.Duration(ewmaAlpha*float64(latency) + (1-ewmaAlpha)*float64(p.ewmaLatency))
+	}
+
+	switch p.state {
+	case peerStateHalfOpen:
+		if err == nil {
+			p.state = peerStateClosed
+			p.cooldown = defaultPeerBaseCooldown
+			return
+		}
+		p.tripLocked()
+	case peerStateClosed:
+		if p.scoreLocked() < threshold {
+			p.tripLocked()
+		}
+	}
+}
+
+// tripLocked opens the circuit and doubles the cooldown, up to a ceiling.
+// Must be called with p.mu held.
+func (p *peerHealth) tripLocked() {
+	p.state = peerStateOpen
+	p.openedAt = time.Now()
+	p.cooldown *= 2
+	if p.cooldown > defaultPeerMaxCooldown {
+		p.cooldown = defaultPeerMaxCooldown
+	}
+}
+
+// scoreLocked combines the error-rate EWMA and latency EWMA into a single
+// [0,1] health score. Must be called with p.mu held.
+func (p *peerHealth) scoreLocked() float64 {
+	latencyPenalty := 1.0
+	if p.ewmaLatency > 0 {
+		latencyPenalty = 1.0 / (1.0 + p.ewmaLatency.Seconds())
+	}
+	return (1 - p.ewmaErrors) * latencyPenalty
+}
+
+func (p *peerHealth) recordLatencyLocked(latency time.Duration) {
+	p.latencies[p.latencyHead] = latency
+	p.latencyHead = (p.latencyHead + 1) % latencyWindowSize
+	if p.latencyLen < latencyWindowSize {
+		p.latencyLen++
+	}
+}
+
+// p95Locked returns the P95 latency over the recent sample window, or zero
+// if no samples have been recorded yet. Must be called with p.mu held.
+func (p *peerHealth) p95Locked() time.Duration {
+	if p.latencyLen == 0 {
+		return 0
+	}
+	buf := make([]time.Duration, p.latencyLen)
+	copy(buf, p.latencies[:p.latencyLen])
+	sort.Slice(buf, func(i, j int) bool { return buf[i] < buf[j] })
+
+	idx := int(math.Ceil(0.95*float64(len(buf)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(buf) {
+		idx = len(buf) - 1
+	}
+	return buf[idx]
+}
+
+// timeout derives a per-request timeout of twice the observed P95 latency,
+// floored at 10ms, falling back to ceiling until at least one sample has been
+// recorded and never exceeding it.
+func (p *peerHealth) timeout(ceiling time.Duration) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p95 := p.p95Locked()
+	if p95 == 0 {
+		return ceiling
+	}
+	t := p95 * 2
+	if t > ceiling {
+		return ceiling
+	}
+	if t < 10*time.Millisecond {
+		return 10 * time.Millisecond
+	}
+	return t
+}
+
+// PeerScore is the health snapshot for a single peer, surfaced via
+// globalManager.PeerScores() and the /peers HTTP endpoint. Stats() does not
+// include peer scores.
+type PeerScore struct {
+	Host      string        `json:"host"`
+	State     string        `json:"state"`
+	Score     float64       `json:"score"`
+	Latency   time.Duration `json:"latency"`
+	ErrorRate float64       `json:"error_rate"`
+}
+
+func (p *peerHealth) snapshot(host string) PeerScore {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PeerScore{
+		Host:      host,
+		State:     p.state.String(),
+		Score:     p.scoreLocked(),
+		Latency:   p.ewmaLatency,
+		ErrorRate: p.ewmaErrors,
+	}
+}
+
+// peerHealthThreshold returns the configured score threshold below which a
+// peer is tripped open, falling back to defaultPeerHealthThreshold.
+func (gm *globalManager) peerHealthThreshold() float64 {
+	if gm.conf.GlobalPeerHealthThreshold > 0 {
+		return gm.conf.GlobalPeerHealthThreshold
+	}
+	return defaultPeerHealthThreshold
+}
+
+// peerHealthFor returns the health tracker for host, creating one on first
+// use.
+func (gm *globalManager) peerHealthFor(host string) *peerHealth {
+	gm.healthMu.Lock()
+	defer gm.healthMu.Unlock()
+
+	ph, ok := gm.health[host]
+	if !ok {
+		ph = newPeerHealth()
+		gm.health[host] = ph
+	}
+	return ph
+}
+
+// PeerScores returns a health snapshot of every peer globalManager has
+// broadcast to so far.
+func (gm *globalManager) PeerScores() []PeerScore {
+	gm.healthMu.Lock()
+	defer gm.healthMu.Unlock()
+
+	scores := make([]PeerScore, 0, len(gm.health))
+	for host, ph := range gm.health {
+		scores = append(scores, ph.snapshot(host))
+	}
+	return scores
+}
+
+// ServeHTTP implements the "/peers" debug endpoint, reporting the current
+// health score and circuit-breaker state of every peer this globalManager
+// has broadcast to.
+func (gm *globalManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(gm.PeerScores()); err != nil {
+		gm.log.WithError(err).Error("while encoding /peers response")
+	}
+}
+
+// RegisterHTTP exposes gm's peer health scores on mux's "/peers" endpoint.
+// It's not wired up automatically: http.DefaultServeMux isn't what the real
+// server listens on, and a process-global registration can't be scoped to a
+// particular globalManager when more than one is constructed in the same
+// process (e.g. in tests). Callers that own the server's mux register it
+// explicitly, once per globalManager.
+func (gm *globalManager) RegisterHTTP(mux *http.ServeMux) {
+	mux.Handle("/peers", gm)
+}
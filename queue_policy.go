@@ -0,0 +1,118 @@
+package gubernator
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// OverflowPolicy controls what happens to a hit or update when globalManager's
+// async/broadcast queues are full because the run loop is busy talking to
+// peers.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the caller until the queue has room; this is the
+	// historical behavior.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropAndCount drops the request immediately and increments
+	// DroppedHits (DroppedUpdates for status updates) rather than stalling
+	// the request-serving goroutine.
+	OverflowDropAndCount
+	// OverflowSample probabilistically drops the request, scaling up the
+	// Hits of requests that survive so the aggregate count stays unbiased.
+	OverflowSample
+)
+
+const (
+	defaultGlobalQueueLimit   = 1000
+	defaultOverflowSampleRate = 0.1
+)
+
+// queueLimit returns the configured buffer size for the async/broadcast
+// queues, falling back to defaultGlobalQueueLimit.
+func (gm *globalManager) queueLimit() int {
+	if gm.conf.GlobalQueueLimit > 0 {
+		return gm.conf.GlobalQueueLimit
+	}
+	return defaultGlobalQueueLimit
+}
+
+func (gm *globalManager) overflowPolicy() OverflowPolicy {
+	return gm.conf.GlobalOverflowPolicy
+}
+
+// sampleRate returns the probability that a dropped hit survives under
+// OverflowSample, falling back to defaultOverflowSampleRate.
+func (gm *globalManager) sampleRate() float64 {
+	if gm.conf.GlobalOverflowSampleRate > 0 && gm.conf.GlobalOverflowSampleRate <= 1 {
+		return gm.conf.GlobalOverflowSampleRate
+	}
+	return defaultOverflowSampleRate
+}
+
+// enqueueHit places e on the async hit queue according to the configured
+// OverflowPolicy, incrementing DroppedHits/SampledHits as appropriate instead
+// of silently blocking the request-serving goroutine.
+func (gm *globalManager) enqueueHit(e *hitEnvelope) {
+	select {
+	case gm.asyncQueue <- e:
+		return
+	default:
+	}
+
+	switch gm.overflowPolicy() {
+	case OverflowDropAndCount:
+		atomic.AddInt64(&gm.droppedHits, 1)
+	case OverflowSample:
+		rate := gm.sampleRate()
+		if rand.Float64() >= rate {
+			atomic.AddInt64(&gm.droppedHits, 1)
+			return
+		}
+		sampled := *e.req
+		sampled.Hits = int64(float64(e.req.Hits) / rate)
+		scaled := &hitEnvelope{req: &sampled, enqueuedAt: e.enqueuedAt}
+		select {
+		case gm.asyncQueue <- scaled:
+			atomic.AddInt64(&gm.sampledHits, 1)
+		default:
+			atomic.AddInt64(&gm.droppedHits, 1)
+		}
+	default: // OverflowBlock
+		gm.asyncQueue <- e
+	}
+}
+
+// requeueHit places e back on the async hit queue without ever blocking,
+// regardless of OverflowPolicy. It exists for runAsyncHits/sendHits to
+// re-queue a batch skipped by an open circuit breaker: that code runs on the
+// asyncQueue's sole consumer goroutine, so a blocking send there (as
+// OverflowBlock would otherwise do) would deadlock forever waiting for a
+// drain that can only happen after it returns.
+func (gm *globalManager) requeueHit(e *hitEnvelope) {
+	select {
+	case gm.asyncQueue <- e:
+	default:
+		atomic.AddInt64(&gm.droppedHits, 1)
+	}
+}
+
+// enqueueUpdate places r on the broadcast queue according to the configured
+// OverflowPolicy. Status broadcasts aren't counted by Hits, so unlike
+// enqueueHit there's no sampling mode; a full queue either blocks or drops,
+// counted separately from DroppedHits so operators can tell a burst of
+// overflowing hits apart from overflowing status updates. OverflowSample
+// therefore degrades to a plain drop here: there's no Hits count to scale up
+// on the updates that do get through.
+func (gm *globalManager) enqueueUpdate(r *RateLimitReq) {
+	if gm.overflowPolicy() == OverflowBlock {
+		gm.broadcastQueue <- r
+		return
+	}
+
+	select {
+	case gm.broadcastQueue <- r:
+	default:
+		atomic.AddInt64(&gm.droppedUpdates, 1)
+	}
+}
@@ -0,0 +1,284 @@
+package gubernator
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	retryBaseBackoff = 500 * time.Millisecond
+	retryMaxBackoff  = 30 * time.Second
+	retryMaxAttempts = 10
+	retryInterval    = time.Second
+)
+
+// retryItem is a single failed status update pending retry, coalesced by Key
+// so a newer status for the same rate limit supersedes an older,
+// not-yet-retried one.
+//
+// Only UpdatePeerGlobal status broadcasts go through this queue. They're
+// idempotent full snapshots, so retrying one repeatedly is safe. Hit deltas
+// are not: a GetPeerRateLimitsReq that appears to fail may have still been
+// applied by the owner, and re-sending it would double-count. See the error
+// handling in globalManager.sendHits.
+type retryItem struct {
+	Key         string            `json:"key"`
+	Update      *UpdatePeerGlobal `json:"update"`
+	Attempts    int               `json:"attempts"`
+	NextAttempt time.Time         `json:"next_attempt"`
+}
+
+// scheduleNext advances the item's backoff, capped at retryMaxBackoff, and adds
+// up to half that backoff again as jitter to avoid synchronized retry storms
+// against a recovering peer, so the delay can reach 1.5x retryMaxBackoff.
+func (it *retryItem) scheduleNext() {
+	it.Attempts++
+	shift := uint(it.Attempts)
+	if shift > 10 {
+		shift = 10
+	}
+	backoff := retryBaseBackoff * time.Duration(uint64(1)<<shift)
+	if backoff > retryMaxBackoff {
+		backoff = retryMaxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+	it.NextAttempt = time.Now().Add(backoff + jitter)
+}
+
+// peerRetryQueue holds status update broadcasts that failed to reach a
+// single peer, retrying them with exponential backoff and jitter until they
+// succeed, are superseded, or exhaust retryMaxAttempts. If spillDir is set,
+// the queue is persisted to a per-peer JSON file so pending updates survive
+// a restart.
+type peerRetryQueue struct {
+	mu       sync.Mutex
+	host     string
+	items    map[string]*retryItem
+	spillDir string
+}
+
+func newPeerRetryQueue(host, spillDir string) *peerRetryQueue {
+	q := &peerRetryQueue{
+		host:     host,
+		items:    make(map[string]*retryItem),
+		spillDir: spillDir,
+	}
+	q.load()
+	return q
+}
+
+func (q *peerRetryQueue) spillPath() string {
+	if q.spillDir == "" {
+		return ""
+	}
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(q.host)
+	return filepath.Join(q.spillDir, name+".json")
+}
+
+// load restores any items spilled to disk by a previous run.
+func (q *peerRetryQueue) load() {
+	path := q.spillPath()
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var items []*retryItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, it := range items {
+		q.items[it.Key] = it
+	}
+}
+
+// persistLocked rewrites the spill file with the current set of pending
+// items. Must be called with q.mu held.
+func (q *peerRetryQueue) persistLocked() {
+	path := q.spillPath()
+	if path == "" {
+		return
+	}
+	items := make([]*retryItem, 0, len(q.items))
+	for _, it := range q.items {
+		items = append(items, it)
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(q.spillDir, 0o755); err != nil {
+		return
+	}
+	_ = os.WriteFile(path, data, 0o600)
+}
+
+// put inserts or replaces the item for it.Key, so a newer status always
+// supersedes an older, not-yet-retried one.
+func (q *peerRetryQueue) put(it *retryItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items[it.Key] = it
+	q.persistLocked()
+}
+
+func (q *peerRetryQueue) remove(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.items, key)
+	q.persistLocked()
+}
+
+// due returns the items whose backoff has elapsed, ready to retry.
+func (q *peerRetryQueue) due() []*retryItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	var due []*retryItem
+	for _, it := range q.items {
+		if !it.NextAttempt.After(now) {
+			due = append(due, it)
+		}
+	}
+	return due
+}
+
+func (q *peerRetryQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// retryQueueFor returns the retry queue for host, creating one on first use.
+func (gm *globalManager) retryQueueFor(host string) *peerRetryQueue {
+	gm.retryMu.Lock()
+	defer gm.retryMu.Unlock()
+
+	q, ok := gm.retryQueues[host]
+	if !ok {
+		q = newPeerRetryQueue(host, gm.conf.PersistRetryDir)
+		gm.retryQueues[host] = q
+	}
+	return q
+}
+
+func (gm *globalManager) retryQueueDepth() int64 {
+	gm.retryMu.Lock()
+	defer gm.retryMu.Unlock()
+
+	var depth int64
+	for _, q := range gm.retryQueues {
+		depth += int64(q.depth())
+	}
+	return depth
+}
+
+// peerClientByHost returns the PeerClient for host, or nil if it's no longer
+// part of the cluster.
+func (gm *globalManager) peerClientByHost(host string) *PeerClient {
+	for _, peer := range gm.instance.GetPeerList() {
+		if peer.host == host {
+			return peer
+		}
+	}
+	return nil
+}
+
+// runRetries periodically drains each peer's retry queue until items
+// succeed, are superseded, or exhaust their retry budget.
+func (gm *globalManager) runRetries() {
+	var interval = NewInterval(retryInterval)
+	interval.Next()
+
+	gm.wg.Until(func(done chan struct{}) bool {
+		select {
+		case <-interval.C:
+			gm.drainRetries()
+			interval.Next()
+		case <-done:
+			return false
+		}
+		return true
+	})
+}
+
+func (gm *globalManager) drainRetries() {
+	gm.retryMu.Lock()
+	queues := make([]*peerRetryQueue, 0, len(gm.retryQueues))
+	for _, q := range gm.retryQueues {
+		queues = append(queues, q)
+	}
+	gm.retryMu.Unlock()
+
+	for _, q := range queues {
+		gm.drainPeerRetries(q)
+	}
+}
+
+// drainPeerRetries retries every due item for a single peer, respecting
+// peer-health gating and GlobalTimeout.
+func (gm *globalManager) drainPeerRetries(q *peerRetryQueue) {
+	peer := gm.peerClientByHost(q.host)
+	if peer == nil {
+		return
+	}
+
+	// Check for due items before allow(): allow() may hand out the single
+	// half-open probe, which must be followed by a report().
+	due := q.due()
+	if len(due) == 0 {
+		return
+	}
+
+	ph := gm.peerHealthFor(q.host)
+	if !ph.allow() {
+		return
+	}
+
+	// settle applies fn only if it is still the pending item for its key, so
+	// a newer status put meanwhile by updatePeers is neither lost nor
+	// overwritten by this older one.
+	settle := func(it *retryItem, fn func()) {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.items[it.Key] == it {
+			fn()
+			q.persistLocked()
+		}
+	}
+
+	for _, it := range due {
+		if it.Attempts >= retryMaxAttempts {
+			settle(it, func() { delete(q.items, it.Key) })
+			atomic.AddInt64(&gm.retriesAbandoned, 1)
+			gm.log.Warnf("abandoning retry of '%s' for peer '%s' after %d attempts", it.Key, q.host, it.Attempts)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), ph.timeout(gm.conf.GlobalTimeout))
+		start := time.Now()
+		_, err := peer.UpdatePeerGlobals(ctx, &UpdatePeerGlobalsReq{Globals: []*UpdatePeerGlobal{it.Update}})
+		cancel()
+		ph.report(time.Since(start), err, gm.peerHealthThreshold())
+
+		if err != nil {
+			settle(it, it.scheduleNext)
+			continue
+		}
+
+		settle(it, func() { delete(q.items, it.Key) })
+		atomic.AddInt64(&gm.retriesSucceeded, 1)
+	}
+}